@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+// Container lifecycle job types, tracked individually in
+// WorkerPool.numJobsByType so regressions in one operation don't get
+// averaged away by the others.
+const (
+	opContainerCreate = "ContainerCreate"
+	opContainerStart  = "ContainerStart"
+	opContainerExec   = "ContainerExec"
+	opContainerStop   = "ContainerStop"
+	opContainerKill   = "ContainerKill"
+	opContainerRename = "ContainerRename"
+	opContainerRemove = "ContainerRemove"
+)
+
+// ContainerLifecycleConfig configures the container churn workload that
+// runs alongside image tagging/building in stress.
+type ContainerLifecycleConfig struct {
+	NumContainers        int
+	NumExecsPerContainer int
+
+	// ChurnRatio is the fraction (0-1) of containers that are stopped or
+	// killed (one or the other) before being renamed and removed, rather
+	// than renamed and removed directly. Both paths exercise
+	// ContainerRename and ContainerRemove; ChurnRatio controls how much of
+	// the stop/kill path gets exercised alongside them.
+	ChurnRatio float64
+}
+
+// latencyRecorder collects per-operation-kind latency samples so stress
+// can report p50/p95/p99 at each benchmark iteration.
+type latencyRecorder struct {
+	mu      sync.Mutex
+	samples map[string][]time.Duration
+}
+
+func newLatencyRecorder() *latencyRecorder {
+	return &latencyRecorder{samples: make(map[string][]time.Duration)}
+}
+
+func (l *latencyRecorder) observe(op string, d time.Duration) {
+	l.mu.Lock()
+	l.samples[op] = append(l.samples[op], d)
+	l.mu.Unlock()
+}
+
+// Report renders a p50/p95/p99 summary per operation kind, sorted by name
+// so output is stable across runs.
+func (l *latencyRecorder) Report() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var ops []string
+	for op := range l.samples {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	var lines []string
+	for _, op := range ops {
+		durs := append([]time.Duration(nil), l.samples[op]...)
+		sort.Slice(durs, func(i, j int) bool { return durs[i] < durs[j] })
+
+		lines = append(lines, fmt.Sprintf("%s: p50=%s p95=%s p99=%s (n=%d)",
+			op, percentile(durs, 0.50), percentile(durs, 0.95), percentile(durs, 0.99), len(durs)))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	idx := int(p * float64(len(sorted)))
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+
+	return sorted[idx]
+}
+
+// containerLifecycle submits the create/start/exec/churn/remove chain for
+// cfg.NumContainers containers onto pool, one Job per stage per container,
+// so that ContainerStart for one container can run while ContainerCreate
+// is still pending for another. Every stage's duration is recorded in lat
+// under its own operation kind.
+func containerLifecycle(ctx context.Context, cln client.CommonAPIClient, pool *WorkerPool, lat *latencyRecorder, ref string, cfg ContainerLifecycleConfig) {
+	for i := 0; i < cfg.NumContainers; i++ {
+		i := i
+		name := fmt.Sprintf("stress-ctr-%d", i)
+
+		pool.Submit(Job{
+			Type:  opContainerCreate,
+			Index: i,
+			Run: func() error {
+				created, err := cln.ContainerCreate(ctx, &container.Config{
+					Image: ref,
+					Cmd:   []string{"sleep", "3600"},
+				}, nil, nil, name)
+				if err != nil {
+					return errors.Wrapf(err, "failed to create container %s", name)
+				}
+
+				submitContainerStart(ctx, cln, pool, lat, created.ID, i, cfg)
+				return nil
+			},
+		})
+	}
+}
+
+func submitContainerStart(ctx context.Context, cln client.CommonAPIClient, pool *WorkerPool, lat *latencyRecorder, id string, idx int, cfg ContainerLifecycleConfig) {
+	pool.Submit(Job{
+		Type:  opContainerStart,
+		Index: idx,
+		Run: func() error {
+			if err := cln.ContainerStart(ctx, id, types.ContainerStartOptions{}); err != nil {
+				return errors.Wrapf(err, "failed to start container %s", id)
+			}
+
+			for e := 0; e < cfg.NumExecsPerContainer; e++ {
+				submitContainerExec(ctx, cln, pool, lat, id, idx)
+			}
+
+			submitContainerChurn(ctx, cln, pool, lat, id, idx, cfg)
+			return nil
+		},
+	})
+}
+
+func submitContainerExec(ctx context.Context, cln client.CommonAPIClient, pool *WorkerPool, lat *latencyRecorder, id string, idx int) {
+	pool.Submit(Job{
+		Type:  opContainerExec,
+		Index: idx,
+		Run: func() error {
+			exec, err := cln.ContainerExecCreate(ctx, id, types.ExecConfig{
+				Cmd: []string{"true"},
+			})
+			if err != nil {
+				return errors.Wrapf(err, "failed to create exec on container %s", id)
+			}
+
+			if err := cln.ContainerExecStart(ctx, exec.ID, types.ExecStartCheck{}); err != nil {
+				return errors.Wrapf(err, "failed to start exec %s on container %s", exec.ID, id)
+			}
+
+			return nil
+		},
+	})
+}
+
+// submitContainerChurn decides, per ChurnRatio, whether this container is
+// torn down directly (renamed and removed) or churned first. A churned
+// container takes exactly one shutdown path, stop or kill chosen with equal
+// probability, before being renamed and removed; stopping it and then also
+// killing it would just be racing ContainerKill against an already-stopped
+// container for no added coverage.
+func submitContainerChurn(ctx context.Context, cln client.CommonAPIClient, pool *WorkerPool, lat *latencyRecorder, id string, idx int, cfg ContainerLifecycleConfig) {
+	if rand.Float64() >= cfg.ChurnRatio {
+		submitContainerRename(ctx, cln, pool, lat, id, idx)
+		return
+	}
+
+	if rand.Float64() < 0.5 {
+		pool.Submit(Job{
+			Type:  opContainerStop,
+			Index: idx,
+			Run: func() error {
+				timeout := 5 * time.Second
+				if err := cln.ContainerStop(ctx, id, &timeout); err != nil {
+					return errors.Wrapf(err, "failed to stop container %s", id)
+				}
+
+				submitContainerRename(ctx, cln, pool, lat, id, idx)
+				return nil
+			},
+		})
+		return
+	}
+
+	pool.Submit(Job{
+		Type:  opContainerKill,
+		Index: idx,
+		Run: func() error {
+			if err := cln.ContainerKill(ctx, id, "SIGKILL"); err != nil {
+				return errors.Wrapf(err, "failed to kill container %s", id)
+			}
+
+			submitContainerRename(ctx, cln, pool, lat, id, idx)
+			return nil
+		},
+	})
+}
+
+func submitContainerRename(ctx context.Context, cln client.CommonAPIClient, pool *WorkerPool, lat *latencyRecorder, id string, idx int) {
+	pool.Submit(Job{
+		Type:  opContainerRename,
+		Index: idx,
+		Run: func() error {
+			newName := fmt.Sprintf("stress-ctr-%d-churned", idx)
+			if err := cln.ContainerRename(ctx, id, newName); err != nil {
+				return errors.Wrapf(err, "failed to rename container %s", id)
+			}
+
+			pool.Submit(Job{
+				Type:  opContainerRemove,
+				Index: idx,
+				Run: func() error {
+					err := cln.ContainerRemove(ctx, id, types.ContainerRemoveOptions{Force: true})
+					if err != nil {
+						return errors.Wrapf(err, "failed to remove container %s", id)
+					}
+					return nil
+				},
+			})
+
+			return nil
+		},
+	})
+}
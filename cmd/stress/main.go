@@ -2,17 +2,17 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
-	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/docker/cli/cli/command"
 	"github.com/docker/cli/cli/command/image/build"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
@@ -24,21 +24,56 @@ import (
 )
 
 func main() {
-	err := run()
+	scenarioPath := flag.String("scenario", "", "path to a YAML or JSON scenario file describing phases to run; if unset, runs the built-in default scenario")
+	metricsAddr := flag.String("metrics-addr", "", "serve Prometheus metrics at this address (e.g. :9090); if unset, metrics are logged instead")
+	flag.Parse()
+
+	err := run(*scenarioPath, *metricsAddr)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func run() error {
+func run(scenarioPath, metricsAddr string) error {
 	cln, err := client.NewEnvClient()
 	if err != nil {
-		errors.Wrap(err, "failed to get new env client")
+		return errors.Wrap(err, "failed to get new env client")
 	}
 
 	ctx := context.Background()
 
-	err = bootstrap(ctx, cln, BootstrapConfig{
+	var metrics Metrics
+	if metricsAddr != "" {
+		metrics = NewPrometheusMetrics(metricsAddr)
+	} else {
+		metrics = NewLogMetrics()
+	}
+
+	tm := NewTransferManager(ctx, metrics, map[TransferKind]int{
+		TransferPull:   4,
+		TransferPush:   4,
+		TransferBuild:  8,
+		TransferTag:    32,
+		TransferRemove: 16,
+	})
+
+	if scenarioPath == "" {
+		return runDefaultScenario(ctx, cln, tm, metrics)
+	}
+
+	sc, err := loadScenario(scenarioPath)
+	if err != nil {
+		return err
+	}
+
+	return runScenario(ctx, cln, tm, metrics, sc)
+}
+
+// runDefaultScenario runs this tool's original hard-coded bootstrap and
+// stress workloads, with the container lifecycle workload added to the
+// stress phase, for callers that don't pass -scenario.
+func runDefaultScenario(ctx context.Context, cln client.CommonAPIClient, tm *TransferManager, metrics Metrics) error {
+	err := bootstrap(ctx, cln, tm, metrics, BootstrapConfig{
 		Ref:       "busybox",
 		NumImages: 1000,
 	})
@@ -46,11 +81,14 @@ func run() error {
 		return errors.Wrap(err, "failed to bootstrap")
 	}
 
-	err = stress(ctx, cln, StressConfig{
-		Ref:           "busybox",
-		NumBenchmarks: 10,
-		NumTags:       1000,
-		NumBuilds:     100,
+	err = stress(ctx, cln, tm, metrics, StressConfig{
+		Ref:                  "busybox",
+		NumBenchmarks:        10,
+		NumTags:              1000,
+		NumBuilds:            100,
+		NumContainers:        200,
+		NumExecsPerContainer: 5,
+		ChurnRatio:           0.5,
 	})
 	if err != nil {
 		return errors.Wrap(err, "failed to stress")
@@ -60,46 +98,59 @@ func run() error {
 }
 
 type BootstrapConfig struct {
-	Ref       string
-	NumImages int
+	Ref       string `yaml:"ref" json:"ref"`
+	NumImages int    `yaml:"numImages" json:"numImages"`
 }
 
-func bootstrap(ctx context.Context, cln client.CommonAPIClient, cfg BootstrapConfig) error {
+func bootstrap(ctx context.Context, cln client.CommonAPIClient, tm *TransferManager, metrics Metrics, cfg BootstrapConfig) error {
 	log.Println("Start bootstrapping")
-	rc, err := cln.ImagePull(ctx, cfg.Ref, types.ImagePullOptions{})
-	if err != nil {
-		return errors.Wrapf(err, "failed to pull %q", cfg.Ref)
-	}
-	defer rc.Close()
 
-	err = jsonmessage.DisplayJSONMessagesToStream(rc, command.NewOutStream(os.Stdout), nil)
-	if err != nil {
-		return errors.Wrap(err, "failed to display pull")
+	pull := tm.Submit(TransferRequest{
+		Kind: TransferPull,
+		Key:  fmt.Sprintf("pull:%s", cfg.Ref),
+		Run: func(ctx context.Context) (io.ReadCloser, error) {
+			return cln.ImagePull(ctx, cfg.Ref, types.ImagePullOptions{})
+		},
+	})
+	pullEvents := pull.Watch()
+	for msg := range pullEvents {
+		logProgress(msg)
+	}
+	pull.Release(pullEvents)
+	if err := pull.Err(); err != nil {
+		return errors.Wrapf(err, "failed to pull %q", cfg.Ref)
 	}
-
-	pool := NewWorkerPool(100, cfg.NumImages)
-	defer close(pool.Done)
 
 	var wg sync.WaitGroup
-	err = bench(func() error {
+	var mu sync.Mutex
+	var errs multiError
+
+	err := withMetrics(metrics, "bootstrap.tag_phase", "phase_failed", func() error {
 		wg.Add(cfg.NumImages)
 		log.Printf("Tagging %d images", cfg.NumImages)
 		for i := 0; i < cfg.NumImages; i++ {
 			i := i
-			pool.Jobs <- Job{
-				Type: "ImageTags",
-				Run: func() error {
-					defer wg.Done()
-
-					ref := fmt.Sprintf("image-%d", i)
-					err := cln.ImageTag(ctx, cfg.Ref, ref)
-					if err != nil {
-						return errors.Wrapf(err, "failed to tag %s as %s", cfg.Ref, ref)
-					}
-
-					return nil
-				},
-			}
+			go func() {
+				defer wg.Done()
+
+				ref := fmt.Sprintf("image-%d", i)
+				t := tm.Submit(TransferRequest{
+					Kind: TransferTag,
+					Key:  fmt.Sprintf("tag:%s->%s", cfg.Ref, ref),
+					Run: func(ctx context.Context) (io.ReadCloser, error) {
+						return nil, cln.ImageTag(ctx, cfg.Ref, ref)
+					},
+				})
+				events := t.Watch()
+				for range events {
+				}
+				t.Release(events)
+				if err := t.Err(); err != nil {
+					mu.Lock()
+					errs = append(errs, errors.Wrapf(err, "failed to tag %s as %s", cfg.Ref, ref))
+					mu.Unlock()
+				}
+			}()
 		}
 
 		return nil
@@ -109,67 +160,113 @@ func bootstrap(ctx context.Context, cln client.CommonAPIClient, cfg BootstrapCon
 	}
 
 	wg.Wait()
+	if len(errs) > 0 {
+		return errors.Wrapf(errs, "bootstrap: %d of %d image tags failed", len(errs), cfg.NumImages)
+	}
+
 	log.Println("Finished bootstrapping")
 	return nil
 }
 
+func logProgress(msg jsonmessage.JSONMessage) {
+	if msg.Progress != nil {
+		log.Printf("%s %s", msg.Status, msg.Progress.String())
+		return
+	}
+	log.Printf("%s", msg.Status)
+}
+
 type StressConfig struct {
-	Ref             string
-	NumBenchmarks   int
-	NumTags         int
-	NumBuilds       int
-	NumImageRemoves int
+	Ref             string `yaml:"ref" json:"ref"`
+	NumBenchmarks   int    `yaml:"numBenchmarks" json:"numBenchmarks"`
+	NumTags         int    `yaml:"numTags" json:"numTags"`
+	NumBuilds       int    `yaml:"numBuilds" json:"numBuilds"`
+	NumImageRemoves int    `yaml:"numImageRemoves" json:"numImageRemoves"`
+
+	NumContainers        int     `yaml:"numContainers" json:"numContainers"`
+	NumExecsPerContainer int     `yaml:"numExecsPerContainer" json:"numExecsPerContainer"`
+	ChurnRatio           float64 `yaml:"churnRatio" json:"churnRatio"`
 }
 
-func stress(ctx context.Context, cln client.CommonAPIClient, cfg StressConfig) error {
+func stress(ctx context.Context, cln client.CommonAPIClient, tm *TransferManager, metrics Metrics, cfg StressConfig) error {
 	log.Println("Start stress testing")
 
-	pool := NewWorkerPool(100, cfg.NumTags+cfg.NumBuilds+cfg.NumImageRemoves)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs multiError
+
+	recordErr := func(err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+	}
+
+	lat := newLatencyRecorder()
+	// Per container: create, start, execs, one churn stage (stop or kill),
+	// rename, remove.
+	pool := NewWorkerPool(100, cfg.NumContainers*(5+cfg.NumExecsPerContainer), metrics, lat)
 	defer close(pool.Done)
+	containerLifecycle(ctx, cln, pool, lat, cfg.Ref, ContainerLifecycleConfig{
+		NumContainers:        cfg.NumContainers,
+		NumExecsPerContainer: cfg.NumExecsPerContainer,
+		ChurnRatio:           cfg.ChurnRatio,
+	})
 
-	var wg sync.WaitGroup
+	wg.Add(cfg.NumTags)
 	go func() {
-		wg.Add(cfg.NumTags)
 		for i := 0; i < cfg.NumTags; i++ {
 			i := i
-			pool.Jobs <- Job{
-				Type: "ImageTags",
-				Run: func() error {
-					defer wg.Done()
-
-					ref := fmt.Sprintf("stress-tag-%d", i)
-					err := cln.ImageTag(ctx, cfg.Ref, ref)
-					if err != nil {
-						return errors.Wrapf(err, "failed to tag %s as %s", cfg.Ref, ref)
-					}
-
-					return nil
-				},
-			}
+			go func() {
+				defer wg.Done()
+
+				ref := fmt.Sprintf("stress-tag-%d", i)
+				t := tm.Submit(TransferRequest{
+					Kind: TransferTag,
+					Key:  fmt.Sprintf("tag:%s->%s", cfg.Ref, ref),
+					Run: func(ctx context.Context) (io.ReadCloser, error) {
+						return nil, cln.ImageTag(ctx, cfg.Ref, ref)
+					},
+				})
+				events := t.Watch()
+				for range events {
+				}
+				t.Release(events)
+				if err := t.Err(); err != nil {
+					recordErr(errors.Wrapf(err, "failed to tag %s as %s", cfg.Ref, ref))
+				}
+			}()
 		}
 	}()
 
+	wg.Add(cfg.NumBuilds)
 	go func() {
-		wg.Add(cfg.NumBuilds)
 		for i := 0; i < cfg.NumBuilds; i++ {
 			i := i
-			pool.Jobs <- Job{
-				Type: "ImageBuilds",
-				Run: func() error {
-					defer wg.Done()
-					return ImageBuild(ctx, cln, i)
-				},
-			}
+			go func() {
+				defer wg.Done()
+
+				ref := fmt.Sprintf("stress-build-%d", i)
+				t := tm.Submit(TransferRequest{
+					Kind: TransferBuild,
+					Key:  fmt.Sprintf("build:%s", ref),
+					Run: func(ctx context.Context) (io.ReadCloser, error) {
+						return ImageBuild(ctx, cln, i)
+					},
+				})
+				events := t.Watch()
+				for range events {
+				}
+				t.Release(events)
+				if err := t.Err(); err != nil {
+					recordErr(errors.Wrapf(err, "failed to build %s", ref))
+				}
+			}()
 		}
 	}()
 
 	for i := 0; i < cfg.NumBenchmarks; i++ {
 		time.Sleep(time.Second)
-		err := bench(func() error {
-			log.Println("--- Jobs summary ---")
-			log.Printf("%s", pool)
-			log.Println("--- end ---")
-
+		err := withMetrics(metrics, "stress.bench_iteration", "bench_failed", func() error {
 			images, err := cln.ImageList(ctx, types.ImageListOptions{})
 			if err != nil {
 				return errors.Wrap(err, "failed to image list")
@@ -184,6 +281,10 @@ func stress(ctx context.Context, cln client.CommonAPIClient, cfg StressConfig) e
 
 			log.Printf("Found %d image tags", len(tagSet))
 
+			log.Println("--- Container op latencies (p50/p95/p99) ---")
+			log.Printf("%s", lat.Report())
+			log.Println("--- end ---")
+
 			return nil
 		})
 		if err != nil {
@@ -191,25 +292,23 @@ func stress(ctx context.Context, cln client.CommonAPIClient, cfg StressConfig) e
 		}
 	}
 
-	log.Println("Finished stress testing")
-	return nil
-}
+	wg.Wait()
+	if err := pool.Wait(); err != nil {
+		recordErr(err)
+	}
 
-func bench(f func() error) error {
-	log.Println("--- benchmarking ---")
-	startTime := time.Now()
-	defer func() {
-		endTime := time.Now()
-		diff := endTime.Sub(startTime)
-		log.Printf("--- %s ---", diff)
-	}()
+	if len(errs) > 0 {
+		return errors.Wrapf(errs, "stress: %d operations failed", len(errs))
+	}
 
-	return f()
+	log.Println("Finished stress testing")
+	return nil
 }
 
 type Job struct {
-	Type string
-	Run  func() error
+	Type  string
+	Index int
+	Run   func() error
 }
 
 type WorkerPool struct {
@@ -217,14 +316,31 @@ type WorkerPool struct {
 	Done chan struct{}
 
 	numJobsByType *syncmap.Map
+
+	wg     sync.WaitGroup
+	errsMu sync.Mutex
+	errs   multiError
 }
 
-func NewWorkerPool(numWorkers, numJobQueue int) *WorkerPool {
+// NewWorkerPool starts numWorkers goroutines pulling off a job queue of
+// depth numJobQueue. Job failures are appended to an in-memory, mutex-guarded
+// slice rather than sent over a bounded channel, so a burst of failures that
+// exceeds numJobQueue can never block a worker from reaching wg.Done() and
+// deadlock Wait. Each job's duration is timed once and reported to both
+// metrics and lat, rather than each job wrapping its own Run in a second,
+// separate latencyRecorder timer.
+func NewWorkerPool(numWorkers, numJobQueue int, metrics Metrics, lat *latencyRecorder) *WorkerPool {
 	jobs := make(chan Job, numJobQueue)
 	done := make(chan struct{})
 
 	numJobsByType := new(syncmap.Map)
 
+	wp := &WorkerPool{
+		Jobs:          jobs,
+		Done:          done,
+		numJobsByType: numJobsByType,
+	}
+
 	for i := 0; i < numWorkers; i++ {
 		go func(id int) {
 			for {
@@ -238,84 +354,107 @@ func NewWorkerPool(numWorkers, numJobQueue int) *WorkerPool {
 					counterAddr := val.(*int64)
 					atomic.AddInt64(counterAddr, 1)
 
+					metrics.IncInFlight(job.Type)
+					start := time.Now()
 					err := job.Run()
+					d := time.Since(start)
+					metrics.DecInFlight(job.Type)
+					metrics.ObserveDuration(job.Type, d)
+					lat.observe(job.Type, d)
+
 					if err != nil {
-						log.Fatalf("[worker %d] %s: %s", id, job.Type, err)
+						metrics.IncError(job.Type, "job_failed")
+						wp.errsMu.Lock()
+						wp.errs = append(wp.errs, errors.Wrapf(err, "[worker %d] job %d (%s)", id, job.Index, job.Type))
+						wp.errsMu.Unlock()
 					}
 
 					atomic.AddInt64(counterAddr, -1)
+					wp.wg.Done()
 				}
 			}
 		}(i)
 	}
 
-	return &WorkerPool{
-		Jobs:          jobs,
-		Done:          done,
-		numJobsByType: numJobsByType,
-	}
+	return wp
 }
 
-func (wp *WorkerPool) String() string {
-	var summaries []string
-
-	for _, t := range []string{
-		"ImageTags",
-		"ImageBuilds",
-	} {
-		val, ok := wp.numJobsByType.Load(t)
-		if !ok {
-			continue
-		}
+// Submit enqueues job and tracks it so a later call to Wait can block until
+// it, and every job submitted before it, has finished.
+func (wp *WorkerPool) Submit(job Job) {
+	wp.wg.Add(1)
+	wp.Jobs <- job
+}
 
-		counterAddr := val.(*int64)
-		counter := atomic.LoadInt64(counterAddr)
-		summaries = append(summaries, fmt.Sprintf("%s: %d", t, counter))
+// Wait blocks until every job submitted so far has finished, then returns a
+// combined error aggregating every job failure observed, or nil if none
+// failed. Unlike the pool's former behavior, a single failing job no
+// longer tears down the process: callers decide what a partial failure
+// across thousands of operations means for them.
+func (wp *WorkerPool) Wait() error {
+	wp.wg.Wait()
+
+	wp.errsMu.Lock()
+	defer wp.errsMu.Unlock()
+	if len(wp.errs) == 0 {
+		return nil
 	}
+	return wp.errs
+}
+
+// multiError aggregates multiple job failures into a single error, in the
+// style of a multi-error aggregator, so a caller driving thousands of
+// tag/build operations can see every failure from a batch rather than only
+// the first one encountered.
+type multiError []error
 
-	return strings.Join(summaries, "\n")
+func (m multiError) Error() string {
+	msgs := make([]string, len(m))
+	for i, err := range m {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d errors occurred:\n\t* %s", len(m), strings.Join(msgs, "\n\t* "))
 }
 
-func ImageBuild(ctx context.Context, cln client.CommonAPIClient, i int) error {
+func ImageBuild(ctx context.Context, cln client.CommonAPIClient, i int) (io.ReadCloser, error) {
 	dir, err := ioutil.TempDir("", "")
 	if err != nil {
-		return errors.Wrap(err, "failed to create tmp dir")
+		return nil, errors.Wrap(err, "failed to create tmp dir")
 	}
 
 	dockerfileData := []byte(fmt.Sprintf("FROM scratch\nRUN touch data-%d\n", i))
 	err = ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), dockerfileData, 0666)
 	if err != nil {
-		return errors.Wrap(err, "failed to write dockerfile")
+		return nil, errors.Wrap(err, "failed to write dockerfile")
 	}
 
 	contextDir, dockerfile, err := build.GetContextFromLocalDir(dir, "")
 	if err != nil {
-		return errors.Wrap(err, "failed to get context from local dir")
+		return nil, errors.Wrap(err, "failed to get context from local dir")
 	}
 
 	dockerfile, err = archive.CanonicalTarNameForPath(dockerfile)
 	if err != nil {
-		return errors.Wrapf(err, "cannot canonicalize dockerfile path %s", dockerfile)
+		return nil, errors.Wrapf(err, "cannot canonicalize dockerfile path %s", dockerfile)
 	}
 
 	buildCtx, err := archive.TarWithOptions(contextDir, &archive.TarOptions{
 		ChownOpts: &idtools.IDPair{UID: 0, GID: 0},
 	})
 	if err != nil {
-		return errors.Wrap(err, "failed to tar context dir")
+		return nil, errors.Wrap(err, "failed to tar context dir")
 	}
 
 	ref := fmt.Sprintf("stress-build-%d", i)
 	opts := types.ImageBuildOptions{
-		SuppressOutput: true,
-		Dockerfile:     dockerfile,
-		Tags:           []string{ref},
+		Dockerfile: dockerfile,
+		Tags:       []string{ref},
 	}
 
-	_, err = cln.ImageBuild(ctx, buildCtx, opts)
+	resp, err := cln.ImageBuild(ctx, buildCtx, opts)
 	if err != nil {
-		return errors.Wrapf(err, "failed to build image %s", contextDir)
+		return nil, errors.Wrapf(err, "failed to build image %s", contextDir)
 	}
 
-	return nil
+	return resp.Body, nil
 }
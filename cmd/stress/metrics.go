@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Metrics is the instrumentation sink used by bootstrap, stress, and every
+// Docker API call they make. It lets the stress harness emit regression
+// trends that can be graphed across daemon versions instead of eyeballed
+// from wall-clock log lines.
+type Metrics interface {
+	ObserveDuration(op string, d time.Duration)
+	IncInFlight(op string)
+	DecInFlight(op string)
+	IncError(op, kind string)
+}
+
+// withMetrics runs f, recording its duration under op and its in-flight
+// state for the duration of the call. If f returns an error, it is also
+// counted via IncError under kind.
+func withMetrics(m Metrics, op, kind string, f func() error) error {
+	m.IncInFlight(op)
+	start := time.Now()
+
+	err := f()
+
+	m.DecInFlight(op)
+	m.ObserveDuration(op, time.Since(start))
+	if err != nil {
+		m.IncError(op, kind)
+	}
+
+	return err
+}
+
+// logReportEvery is how many ObserveDuration calls a given op accumulates
+// before logMetrics logs an aggregate line for it. A high-concurrency run
+// can make this call thousands of times a second per op, and logging every
+// one of them drowns out everything else written to stdout.
+const logReportEvery = 500
+
+// logMetrics is the default Metrics implementation: it tracks running
+// count/total-duration/error stats per op in memory and logs an aggregate
+// line every logReportEvery observations, rather than a line per call.
+// In-flight counts are too high-frequency to be worth logging at all, so
+// IncInFlight/DecInFlight are no-ops.
+type logMetrics struct {
+	mu     sync.Mutex
+	count  map[string]int64
+	total  map[string]time.Duration
+	errors map[string]int64
+}
+
+// NewLogMetrics returns a Metrics implementation that periodically logs
+// aggregate per-op stats.
+func NewLogMetrics() Metrics {
+	return &logMetrics{
+		count:  make(map[string]int64),
+		total:  make(map[string]time.Duration),
+		errors: make(map[string]int64),
+	}
+}
+
+func (m *logMetrics) ObserveDuration(op string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.count[op]++
+	m.total[op] += d
+
+	if n := m.count[op]; n%logReportEvery == 0 {
+		log.Printf("[metrics] %s: %d calls, avg %s, %d errors", op, n, m.total[op]/time.Duration(n), m.errors[op])
+	}
+}
+
+func (*logMetrics) IncInFlight(op string) {}
+
+func (*logMetrics) DecInFlight(op string) {}
+
+func (m *logMetrics) IncError(op, kind string) {
+	m.mu.Lock()
+	m.errors[op]++
+	m.mu.Unlock()
+
+	log.Printf("[metrics] %s error (%s)", op, kind)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// PrometheusMetrics exposes operation durations, in-flight counts, and
+// error counts on an HTTP /metrics endpoint, so regression trends can be
+// graphed across Docker daemon versions rather than read off the log.
+type PrometheusMetrics struct {
+	duration *prometheus.HistogramVec
+	inFlight *prometheus.GaugeVec
+	errors   *prometheus.CounterVec
+}
+
+// NewPrometheusMetrics registers the collectors against their own
+// registry, serves them at addr under /metrics, and returns the Metrics
+// implementation to pass into bootstrap/stress. addr is something like
+// ":9090"; ListenAndServe errors are logged, not returned, since the
+// stress run itself shouldn't fail because the exporter couldn't bind.
+func NewPrometheusMetrics(addr string) *PrometheusMetrics {
+	m := &PrometheusMetrics{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "regressdocker",
+			Name:      "operation_duration_seconds",
+			Help:      "Duration of Docker API operations performed by the stress harness.",
+			Buckets:   []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+		}, []string{"op"}),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "regressdocker",
+			Name:      "operations_in_flight",
+			Help:      "Number of Docker API operations currently in flight, by kind.",
+		}, []string{"op"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "regressdocker",
+			Name:      "operation_errors_total",
+			Help:      "Docker API operation failures, by operation kind and error kind.",
+		}, []string{"op", "kind"}),
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(m.duration, m.inFlight, m.errors)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("metrics server on %s stopped: %s", addr, err)
+		}
+	}()
+
+	return m
+}
+
+func (m *PrometheusMetrics) ObserveDuration(op string, d time.Duration) {
+	m.duration.WithLabelValues(op).Observe(d.Seconds())
+}
+
+func (m *PrometheusMetrics) IncInFlight(op string) {
+	m.inFlight.WithLabelValues(op).Inc()
+}
+
+func (m *PrometheusMetrics) DecInFlight(op string) {
+	m.inFlight.WithLabelValues(op).Dec()
+}
+
+func (m *PrometheusMetrics) IncError(op, kind string) {
+	m.errors.WithLabelValues(op, kind).Inc()
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Scenario is the top-level, user-authored file format loaded via
+// -scenario. It lists phases to run in sequence, so a reproducible
+// regression scenario can be committed to a repo and replayed against
+// different Docker daemon versions without recompiling this binary.
+type Scenario struct {
+	Phases []ScenarioPhase `yaml:"phases" json:"phases"`
+}
+
+// ScenarioPhase is a single step of a scenario. Exactly one of Bootstrap,
+// Stress, Mix, or Parallel should be set: Bootstrap and Stress drive this
+// tool's existing workloads as-is, Mix replays a weighted operation mix
+// across Concurrency goroutines, and Parallel fans out to further phases
+// that all run concurrently before the scenario moves on to whatever
+// comes after this phase.
+type ScenarioPhase struct {
+	Name   string `yaml:"name" json:"name"`
+	Repeat int    `yaml:"repeat" json:"repeat"`
+
+	// RampUp is a fixed warm-up delay before this phase's first repeat, not
+	// a gradual increase toward Concurrency; it runs once per phase, not
+	// once per repeat.
+	RampUp      time.Duration `yaml:"rampUp" json:"rampUp"`
+	Concurrency int           `yaml:"concurrency" json:"concurrency"`
+
+	Bootstrap *BootstrapConfig `yaml:"bootstrap,omitempty" json:"bootstrap,omitempty"`
+	Stress    *StressConfig    `yaml:"stress,omitempty" json:"stress,omitempty"`
+	Mix       []WeightedOp     `yaml:"mix,omitempty" json:"mix,omitempty"`
+
+	Parallel []ScenarioPhase `yaml:"parallel,omitempty" json:"parallel,omitempty"`
+}
+
+// WeightedOp is one entry in a phase's operation mix, e.g. "70% tag, 20%
+// build, 10% rm". Weights are normalized against their own total, so they
+// need not sum to 100.
+type WeightedOp struct {
+	Op     string `yaml:"op" json:"op"`
+	Weight int    `yaml:"weight" json:"weight"`
+}
+
+// loadScenario reads a scenario file, decoding it as JSON if its
+// extension is .json and as YAML otherwise.
+func loadScenario(path string) (*Scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read scenario %s", path)
+	}
+
+	var sc Scenario
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		if err := json.Unmarshal(data, &sc); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse scenario %s as JSON", path)
+		}
+		return &sc, nil
+	}
+
+	if err := yaml.Unmarshal(data, &sc); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse scenario %s as YAML", path)
+	}
+	return &sc, nil
+}
+
+// runScenario runs each of sc's phases in order.
+func runScenario(ctx context.Context, cln client.CommonAPIClient, tm *TransferManager, metrics Metrics, sc *Scenario) error {
+	for _, phase := range sc.Phases {
+		if err := runPhase(ctx, cln, tm, metrics, phase); err != nil {
+			return errors.Wrapf(err, "phase %q failed", phase.Name)
+		}
+	}
+	return nil
+}
+
+func runPhase(ctx context.Context, cln client.CommonAPIClient, tm *TransferManager, metrics Metrics, phase ScenarioPhase) error {
+	if len(phase.Parallel) > 0 {
+		return runParallelPhases(ctx, cln, tm, metrics, phase.Parallel)
+	}
+
+	if phase.RampUp > 0 {
+		log.Printf("phase %q: warming up for %s before its first repeat", phase.Name, phase.RampUp)
+		time.Sleep(phase.RampUp)
+	}
+
+	repeat := phase.Repeat
+	if repeat <= 0 {
+		repeat = 1
+	}
+
+	for r := 0; r < repeat; r++ {
+		var err error
+		switch {
+		case phase.Bootstrap != nil:
+			err = bootstrap(ctx, cln, tm, metrics, *phase.Bootstrap)
+		case phase.Stress != nil:
+			err = stress(ctx, cln, tm, metrics, *phase.Stress)
+		case len(phase.Mix) > 0:
+			err = runMix(ctx, cln, tm, phase)
+		default:
+			err = errors.Errorf("phase %q declares no bootstrap, stress, mix, or parallel steps", phase.Name)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "repeat %d/%d", r+1, repeat)
+		}
+	}
+
+	return nil
+}
+
+func runParallelPhases(ctx context.Context, cln client.CommonAPIClient, tm *TransferManager, metrics Metrics, phases []ScenarioPhase) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs multiError
+
+	wg.Add(len(phases))
+	for _, sub := range phases {
+		sub := sub
+		go func() {
+			defer wg.Done()
+
+			if err := runPhase(ctx, cln, tm, metrics, sub); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// runMix replays phase.Mix's weighted operation mix across
+// phase.Concurrency concurrent goroutines, each drawing an operation kind
+// from the mix and submitting it through tm, load-testing-tool style.
+func runMix(ctx context.Context, cln client.CommonAPIClient, tm *TransferManager, phase ScenarioPhase) error {
+	total := 0
+	for _, op := range phase.Mix {
+		total += op.Weight
+	}
+	if total <= 0 {
+		return errors.Errorf("phase %q: operation mix weights must sum to more than 0", phase.Name)
+	}
+
+	concurrency := phase.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs multiError
+
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		i := i
+		go func() {
+			defer wg.Done()
+
+			op := pickWeightedOp(phase.Mix, total)
+			if err := runMixOp(ctx, cln, tm, op, i); err != nil {
+				mu.Lock()
+				errs = append(errs, errors.Wrapf(err, "mix op %q", op))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func pickWeightedOp(mix []WeightedOp, total int) string {
+	r := rand.Intn(total)
+	for _, op := range mix {
+		if r < op.Weight {
+			return op.Op
+		}
+		r -= op.Weight
+	}
+	return mix[len(mix)-1].Op
+}
+
+// runMixOp runs a single operation of the given kind ("tag", "build", or
+// "rm") through tm, keyed so repeated draws of the same (op, i) pair
+// dedupe onto the same Transfer.
+func runMixOp(ctx context.Context, cln client.CommonAPIClient, tm *TransferManager, op string, i int) error {
+	switch op {
+	case "tag":
+		ref := fmt.Sprintf("scenario-tag-%d", i)
+		t := tm.Submit(TransferRequest{
+			Kind: TransferTag,
+			Key:  fmt.Sprintf("tag:busybox->%s", ref),
+			Run: func(ctx context.Context) (io.ReadCloser, error) {
+				return nil, cln.ImageTag(ctx, "busybox", ref)
+			},
+		})
+		return drain(t)
+
+	case "build":
+		t := tm.Submit(TransferRequest{
+			Kind: TransferBuild,
+			Key:  fmt.Sprintf("build:scenario-build-%d", i),
+			Run: func(ctx context.Context) (io.ReadCloser, error) {
+				return ImageBuild(ctx, cln, i)
+			},
+		})
+		return drain(t)
+
+	case "rm":
+		ref := fmt.Sprintf("scenario-tag-%d", i)
+		t := tm.Submit(TransferRequest{
+			Kind: TransferRemove,
+			Key:  fmt.Sprintf("remove:%s", ref),
+			Run: func(ctx context.Context) (io.ReadCloser, error) {
+				_, err := cln.ImageRemove(ctx, ref, types.ImageRemoveOptions{Force: true})
+				return nil, err
+			},
+		})
+		return drain(t)
+
+	default:
+		return errors.Errorf("unknown operation %q", op)
+	}
+}
+
+// drain consumes a Transfer's events until it finishes and returns its
+// terminal error.
+func drain(t *Transfer) error {
+	events := t.Watch()
+	for range events {
+	}
+	t.Release(events)
+	return t.Err()
+}
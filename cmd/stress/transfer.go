@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/pkg/errors"
+)
+
+// TransferKind identifies the category of Docker API operation a Transfer
+// performs. A TransferManager enforces concurrency limits and retries
+// independently per kind.
+type TransferKind string
+
+const (
+	TransferPull   TransferKind = "pull"
+	TransferPush   TransferKind = "push"
+	TransferBuild  TransferKind = "build"
+	TransferTag    TransferKind = "tag"
+	TransferRemove TransferKind = "remove"
+)
+
+// TransferRequest describes a single Docker API call to run under a
+// TransferManager. Run is invoked with the manager's own context rather
+// than the submitting caller's, so a caller that stops watching never
+// cancels the operation for anyone else still attached to it. Run may
+// return a nil ReadCloser for calls that do not stream progress (e.g.
+// ImageTag).
+type TransferRequest struct {
+	Kind     TransferKind
+	Key      string
+	Deadline time.Duration
+	Run      func(ctx context.Context) (io.ReadCloser, error)
+}
+
+// Transfer is a single Docker API operation, possibly still in flight, that
+// more than one caller can attach to and watch progress on. Each Watch
+// call gets its own channel fed by a broadcast from the single underlying
+// attempt, so concurrent watchers of the same Transfer each get their own
+// copy of an event instead of racing each other for it. A watcher whose
+// channel buffer is full misses events while it stays full.
+type Transfer struct {
+	Kind TransferKind
+	Key  string
+
+	done chan struct{}
+
+	mu       sync.Mutex
+	watchers []chan jsonmessage.JSONMessage
+	closed   bool
+	err      error
+}
+
+func newTransfer(kind TransferKind, key string) *Transfer {
+	return &Transfer{
+		Kind: kind,
+		Key:  key,
+		done: make(chan struct{}),
+	}
+}
+
+// Watch registers and returns a new channel of progress events for this
+// transfer. The channel is closed once the transfer finishes,
+// successfully or not, unless it was passed to Release before then.
+func (t *Transfer) Watch() <-chan jsonmessage.JSONMessage {
+	ch := make(chan jsonmessage.JSONMessage, 64)
+
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		close(ch)
+		return ch
+	}
+	t.watchers = append(t.watchers, ch)
+	t.mu.Unlock()
+
+	return ch
+}
+
+// Release stops delivering events to the channel returned by a prior
+// Watch call. It never cancels the underlying operation, which keeps
+// running for any other watcher.
+func (t *Transfer) Release(ch <-chan jsonmessage.JSONMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, w := range t.watchers {
+		if w == ch {
+			t.watchers = append(t.watchers[:i], t.watchers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (t *Transfer) broadcast(msg jsonmessage.JSONMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, w := range t.watchers {
+		select {
+		case w <- msg:
+		default:
+			// Slow watcher; drop the event for it rather than stall the
+			// others or the transfer itself.
+		}
+	}
+}
+
+// Err blocks until the transfer finishes and returns its terminal error, if
+// any.
+func (t *Transfer) Err() error {
+	<-t.done
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+func (t *Transfer) finish(err error) {
+	t.mu.Lock()
+	t.err = err
+	t.closed = true
+	watchers := t.watchers
+	t.watchers = nil
+	t.mu.Unlock()
+
+	for _, w := range watchers {
+		close(w)
+	}
+	close(t.done)
+}
+
+// TransferManager deduplicates in-flight pull/push/build/tag operations by
+// key, bounds concurrency independently per TransferKind, and retries
+// failed transfers with exponential backoff and jitter until a
+// per-transfer deadline elapses. It mirrors the download/upload manager
+// design used by Moby's distribution/xfer package, adapted to the
+// docker/cli client API.
+type TransferManager struct {
+	ctx     context.Context
+	metrics Metrics
+
+	mu       sync.Mutex
+	sem      map[TransferKind]chan struct{}
+	inflight map[string]*Transfer
+}
+
+// NewTransferManager builds a TransferManager whose transfers run under
+// ctx and are instrumented through metrics. maxConcurrency caps the number
+// of simultaneous operations per kind; a kind absent from the map defaults
+// to a concurrency of 1.
+func NewTransferManager(ctx context.Context, metrics Metrics, maxConcurrency map[TransferKind]int) *TransferManager {
+	sem := make(map[TransferKind]chan struct{}, len(maxConcurrency))
+	for kind, n := range maxConcurrency {
+		sem[kind] = make(chan struct{}, n)
+	}
+
+	return &TransferManager{
+		ctx:      ctx,
+		metrics:  metrics,
+		sem:      sem,
+		inflight: make(map[string]*Transfer),
+	}
+}
+
+func (tm *TransferManager) semFor(kind TransferKind) chan struct{} {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	s, ok := tm.sem[kind]
+	if !ok {
+		s = make(chan struct{}, 1)
+		tm.sem[kind] = s
+	}
+	return s
+}
+
+// Submit starts req, or returns the Transfer already in flight for the same
+// Key. The returned Transfer is shared by every caller that submits the
+// same key while it is running.
+func (tm *TransferManager) Submit(req TransferRequest) *Transfer {
+	tm.mu.Lock()
+	if t, ok := tm.inflight[req.Key]; ok {
+		tm.mu.Unlock()
+		return t
+	}
+
+	t := newTransfer(req.Kind, req.Key)
+	tm.inflight[req.Key] = t
+	tm.mu.Unlock()
+
+	go tm.run(req, t)
+
+	return t
+}
+
+func (tm *TransferManager) run(req TransferRequest, t *Transfer) {
+	defer func() {
+		tm.mu.Lock()
+		delete(tm.inflight, req.Key)
+		tm.mu.Unlock()
+	}()
+
+	sem := tm.semFor(req.Kind)
+	sem <- struct{}{}
+	defer func() { <-sem }()
+
+	deadline := req.Deadline
+	if deadline == 0 {
+		deadline = 10 * time.Minute
+	}
+
+	runCtx, cancel := context.WithTimeout(tm.ctx, deadline)
+	defer cancel()
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = withMetrics(tm.metrics, string(req.Kind), "attempt_failed", func() error {
+			return tm.attempt(runCtx, req, t)
+		})
+		if err == nil || runCtx.Err() != nil {
+			break
+		}
+
+		select {
+		case <-time.After(backoffWithJitter(attempt)):
+		case <-runCtx.Done():
+		}
+	}
+
+	if err == nil && runCtx.Err() != nil {
+		err = errors.Wrapf(runCtx.Err(), "transfer %s %q exceeded its deadline", req.Kind, req.Key)
+	}
+
+	t.finish(err)
+}
+
+func (tm *TransferManager) attempt(ctx context.Context, req TransferRequest, t *Transfer) error {
+	rc, err := req.Run(ctx)
+	if err != nil {
+		return err
+	}
+	if rc == nil {
+		return nil
+	}
+	defer rc.Close()
+
+	dec := json.NewDecoder(rc)
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errors.Wrap(err, "failed to decode progress stream")
+		}
+		if msg.Error != nil {
+			return errors.Wrap(msg.Error, "daemon reported an error")
+		}
+
+		t.broadcast(msg)
+	}
+}
+
+// backoffWithJitter returns the delay before retry number attempt+1,
+// doubling a 100ms base up to a 30s ceiling and picking a random delay
+// between half the base and the full base so that many retrying transfers
+// don't all wake up in lockstep.
+func backoffWithJitter(attempt int) time.Duration {
+	if attempt > 9 {
+		attempt = 9
+	}
+	base := 100 * time.Millisecond * time.Duration(int64(1)<<uint(attempt))
+	if base > 30*time.Second {
+		base = 30 * time.Second
+	}
+	return base/2 + time.Duration(rand.Int63n(int64(base)/2+1))
+}